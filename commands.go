@@ -0,0 +1,340 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/davidrjonas/hipchat-addon"
+)
+
+// errUsage means the usage has been printed already.
+var errUsage = errors.New("usage")
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage: ohsnap [flags] [command]
+
+Commands:
+  serve                              Serve the addon (the default)
+  installs list                      List installations
+  installs show ID                   Show an installation, -secrets to include them
+  installs rm ID...                  Delete installations
+  state export [-o FILE]             Write all installations, with secrets, as json
+  state import [-replace] [FILE]     Add installations from json, or stdin
+  send -installation ID MESSAGE      Send a notification to the installation's room
+  descriptor print                   Print the capabilities descriptor
+  descriptor validate                Check the capabilities descriptor
+  simulate -event FILE               Run the webhooks on an event and print what they send
+  simulate -dir DIR [-update]        Run every fixture in DIR against its .expected output
+  fakehipchat [-listen ADDR]         Run a fake HipChat, -install URL to install the addon
+  repl [-user NAME] [-room ID]       Chat with the bot locally as a user in a room
+
+The installs and state commands work on -state-file directly. Stop the server
+first; it would otherwise overwrite the changes with what it has in memory.
+
+Flags:
+`)
+	flag.PrintDefaults()
+}
+
+func runCommand(name string, args []string) error {
+	switch name {
+	case "serve":
+		return serve(args)
+	case "installs":
+		return installsCommand(args)
+	case "state":
+		return stateCommand(args)
+	case "send":
+		return sendCommand(args)
+	case "descriptor":
+		return descriptorCommand(args)
+	case "simulate":
+		return simulateCommand(args)
+	case "fakehipchat":
+		return fakeHipchatCommand(args)
+	case "repl":
+		return replCommand(args)
+	}
+
+	fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+	usage()
+
+	return errUsage
+}
+
+// subcommand splits "list ..." off args, printing usage if there is none.
+func subcommand(args []string) (string, []string, error) {
+	if len(args) == 0 {
+		usage()
+		return "", nil, errUsage
+	}
+	return args[0], args[1:], nil
+}
+
+// openStore reads -state-file. The store panics on a bad file; that is
+// returned as an error here.
+func openStore() (store *addon.FileInstallationStore, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("unable to read state file %s: %v", stateFilename, r)
+		}
+	}()
+
+	return addon.NewFileInstallationStore(stateFilename), nil
+}
+
+// storeDo runs fn turning a panic from writing the store into an error.
+func storeDo(fn func()) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("unable to write state file %s: %v", stateFilename, r)
+		}
+	}()
+
+	fn()
+
+	return nil
+}
+
+func sortedIds(installations addon.InstallationMap) []string {
+	ids := make([]string, 0, len(installations))
+	for id := range installations {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func installsCommand(args []string) error {
+	sub, args, err := subcommand(args)
+	if err != nil {
+		return err
+	}
+
+	store, err := openStore()
+	if err != nil {
+		return err
+	}
+
+	switch sub {
+	case "list":
+		all := store.GetAll()
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "OAUTH ID\tROOM\tGROUP\tAPI URL")
+		for _, id := range sortedIds(all) {
+			i := all[id]
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", i.OauthId, i.RoomId, i.GroupId, i.ApiUrl)
+		}
+		return w.Flush()
+
+	case "show":
+		fs := flag.NewFlagSet("installs show", flag.ExitOnError)
+		secrets := fs.Bool("secrets", false, "Include the oauth secret")
+		fs.Parse(args)
+
+		if fs.NArg() != 1 {
+			return errors.New("installs show takes one installation id")
+		}
+
+		installation := store.Get(fs.Arg(0))
+		if installation == nil {
+			return fmt.Errorf("no installation %s", fs.Arg(0))
+		}
+
+		// Through a map so the installation itself is left alone.
+		b, err := json.Marshal(installation)
+		if err != nil {
+			return err
+		}
+
+		shown := map[string]interface{}{}
+		if err := json.Unmarshal(b, &shown); err != nil {
+			return err
+		}
+
+		if !*secrets {
+			shown["oauthSecret"] = "REDACTED"
+		}
+
+		return printJson(os.Stdout, shown)
+
+	case "rm":
+		if len(args) == 0 {
+			return errors.New("installs rm takes one or more installation ids")
+		}
+
+		for _, id := range args {
+			if store.Get(id) == nil {
+				return fmt.Errorf("no installation %s", id)
+			}
+		}
+
+		for _, id := range args {
+			if err := storeDo(func() { store.Delete(id) }); err != nil {
+				return err
+			}
+			logrus.Infof("Deleted installation %s", id)
+		}
+
+		return nil
+	}
+
+	return fmt.Errorf("unknown installs command %q", sub)
+}
+
+func stateCommand(args []string) error {
+	sub, args, err := subcommand(args)
+	if err != nil {
+		return err
+	}
+
+	store, err := openStore()
+	if err != nil {
+		return err
+	}
+
+	switch sub {
+	case "export":
+		fs := flag.NewFlagSet("state export", flag.ExitOnError)
+		output := fs.String("o", "", "Write to this file instead of stdout")
+		fs.Parse(args)
+
+		var w io.Writer = os.Stdout
+
+		if *output != "" {
+			// Secrets; only for the owner.
+			f, err := os.OpenFile(*output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			w = f
+		}
+
+		return printJson(w, store.GetAll())
+
+	case "import":
+		fs := flag.NewFlagSet("state import", flag.ExitOnError)
+		replace := fs.Bool("replace", false, "Delete installations that are not in the import")
+		fs.Parse(args)
+
+		var r io.Reader = os.Stdin
+
+		if fs.NArg() > 0 {
+			f, err := os.Open(fs.Arg(0))
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			r = f
+		}
+
+		imported := addon.InstallationMap{}
+
+		if err := json.NewDecoder(r).Decode(&imported); err != nil {
+			return fmt.Errorf("unable to read import: %v", err)
+		}
+
+		for id, installation := range imported {
+			if installation == nil || installation.OauthId != id {
+				return fmt.Errorf("installation %s does not have a matching oauthId", id)
+			}
+		}
+
+		return storeDo(func() {
+			if *replace {
+				for id := range store.GetAll() {
+					if _, ok := imported[id]; !ok {
+						store.Delete(id)
+						logrus.Infof("Deleted installation %s", id)
+					}
+				}
+			}
+
+			for _, id := range sortedIds(imported) {
+				store.Add(id, imported[id])
+				logrus.Infof("Imported installation %s", id)
+			}
+		})
+	}
+
+	return fmt.Errorf("unknown state command %q", sub)
+}
+
+func sendCommand(args []string) error {
+	fs := flag.NewFlagSet("send", flag.ExitOnError)
+	installationId := fs.String("installation", "", "The oauth id of the installation to send to")
+	format := fs.String("format", "text", "The message format, text or html")
+	color := fs.String("color", "", "yellow, green, red, purple, gray or random")
+	notify := fs.Bool("notify", false, "Have HipChat notify the room")
+	fs.Parse(args)
+
+	if *installationId == "" || fs.NArg() == 0 {
+		return errors.New("send needs -installation ID and a message")
+	}
+
+	store, err := openStore()
+	if err != nil {
+		return err
+	}
+
+	installation := store.Get(*installationId)
+	if installation == nil {
+		return fmt.Errorf("no installation %s", *installationId)
+	}
+
+	// No outbox here; the server's would be replayed by this process too.
+	a := addon.New(newDescriptor(), store, addon.Logger(addon.NewLogrusLogger(logrus.StandardLogger())))
+
+	return a.SendNotification(installation, &addon.Notification{
+		MessageFormat: *format,
+		Message:       strings.Join(fs.Args(), " "),
+		Notify:        *notify,
+		Color:         *color,
+	})
+}
+
+func descriptorCommand(args []string) error {
+	sub, _, err := subcommand(args)
+	if err != nil {
+		return err
+	}
+
+	descriptor := newDescriptor()
+
+	switch sub {
+	case "print":
+		return printJson(os.Stdout, descriptor)
+	case "validate":
+		if err := descriptor.Validate(); err != nil {
+			return err
+		}
+		for _, warning := range descriptor.PatternWarnings() {
+			fmt.Println("warning:", warning)
+		}
+		fmt.Println("ok")
+		return nil
+	}
+
+	return fmt.Errorf("unknown descriptor command %q", sub)
+}
+
+func printJson(w io.Writer, v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintln(w, string(b))
+
+	return err
+}
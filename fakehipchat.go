@@ -0,0 +1,52 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/davidrjonas/hipchat-addon/fakehipchat"
+)
+
+// fakeHipchatCommand runs a fake HipChat until interrupted, logging what the
+// addon sends it. With -install it installs the addon first.
+func fakeHipchatCommand(args []string) error {
+	fs := flag.NewFlagSet("fakehipchat", flag.ExitOnError)
+	listenOn := fs.String("listen", "127.0.0.1:8081", "The address to serve the fake HipChat on")
+	install := fs.String("install", "", "Install the addon with this descriptor URL once started")
+	roomId := fs.Int("room", 1, "The room to install into")
+	fs.Parse(args)
+
+	server, err := fakehipchat.Start(*listenOn)
+	if err != nil {
+		return err
+	}
+	defer server.Close()
+
+	server.OnNotification = func(n fakehipchat.Notification) {
+		logrus.WithFields(logrus.Fields{
+			"kind":         n.Kind,
+			"installation": n.OauthId,
+			"room_id":      n.RoomId,
+			"user_id":      n.UserId,
+		}).Infof("Received %v", n.Body["message"])
+	}
+
+	logrus.Infof("Fake HipChat at %s, control API under %s/fake/", server.URL, server.URL)
+
+	if *install != "" {
+		installation, err := server.Install(*install, *roomId)
+		if err != nil {
+			return err
+		}
+		logrus.WithField("installation", installation.OauthId).Infof("Installed %s in room %d", *install, *roomId)
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
+
+	return nil
+}
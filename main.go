@@ -1,9 +1,12 @@
 package main
 
 import (
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"net"
 	"os"
 	"strconv"
 	"strings"
@@ -17,6 +20,12 @@ var urlBase string
 var host string
 var port int
 var stateFilename string
+var queryfImage string
+var trustedProxies string
+var tlsCert string
+var tlsKey string
+var tlsMinVersion string
+var httpRedirect string
 
 func init() {
 	logrus.SetOutput(os.Stderr)
@@ -26,51 +35,98 @@ func init() {
 	flag.StringVar(&host, "host", "127.0.0.1", "The IP address on which to listen")
 	flag.IntVar(&port, "port", 3000, "The port on which to listen")
 	flag.StringVar(&stateFilename, "state-file", "state", "The file to read/store state information")
+	flag.StringVar(&tlsCert, "tls-cert", "", "Serve HTTPS with this certificate file, reloaded when it changes")
+	flag.StringVar(&tlsKey, "tls-key", "", "The key file for -tls-cert")
+	flag.StringVar(&tlsMinVersion, "tls-min-version", "1.2", "The oldest TLS version accepted: 1.0, 1.1, 1.2 or 1.3")
+	flag.StringVar(&httpRedirect, "http-redirect", "", "With -tls-cert, also listen for plain HTTP on this address and redirect to HTTPS")
+	flag.StringVar(&trustedProxies, "trusted-proxies", "", "Comma separated addresses or CIDRs of proxies whose X-Forwarded-* headers set the public URL")
+	flag.StringVar(&queryfImage, "queryf-image", "", "URL of a queryf meme to attach to replies as an image card")
 }
 
-func onYraQuery(a *addon.HipchatAddon, installation *addon.Installation, webhook *addon.WebHook, event map[string]interface{}) error {
+// The webhook's pattern lets queries through; the rules decide the reply.
+var yraRules = []*addon.MessageRule{
+	{Name: "debug", Pattern: `debug`, Callback: onDebug},
+	{Name: "query", Pattern: `(?i)quer(y|ies)`, Callback: onYraQuery},
+}
+
+func ruleLogger(installation *addon.Installation, match *addon.MessageMatch) *logrus.Entry {
+	return logrus.WithFields(logrus.Fields{
+		addon.FieldInstallation: installation.OauthId,
+		addon.FieldRoomId:       installation.RoomId,
+		addon.FieldWebhook:      match.WebHook.Name,
+		addon.FieldRule:         match.Rule.Name,
+	})
+}
+
+func senderMentionName(event map[string]interface{}) (string, error) {
+	return jsonq.NewQuery(event).String("item", "message", "from", "mention_name")
+}
+
+// onDebug sends djonas the whole event privately; it is noise for the rest
+// of the room.
+func onDebug(a *addon.HipchatAddon, installation *addon.Installation, match *addon.MessageMatch, event map[string]interface{}) error {
+	if name, _ := senderMentionName(event); name != "djonas" {
+		return nil
+	}
 
 	var msg string
 
-	jq := jsonq.NewQuery(event)
+	b, err := json.MarshalIndent(event, "", "  ")
+	if err != nil {
+		msg = fmt.Sprintf("Error marshalling json: %q", err)
+	} else {
+		msg = string(b[:])
+	}
+
+	return reply(a, installation, match, event, addon.DeliverPrivately, msg, nil)
+}
 
-	name, err := jq.String("item", "message", "from", "mention_name")
+func onYraQuery(a *addon.HipchatAddon, installation *addon.Installation, match *addon.MessageMatch, event map[string]interface{}) error {
+
+	var msg string
+	var card *addon.Card
+
+	name, err := senderMentionName(event)
 
 	if err != nil {
-		logrus.Error(err)
+		ruleLogger(installation, match).Warnf("no mention name: %v", err)
 	}
 
 	switch name {
 	case "kbussche":
 		msg = "@kbussche You're a qwerty."
 	case "djonas":
-		if s, _ := jq.String("item", "message", "message"); strings.Contains(s, "debug") {
-			b, err := json.MarshalIndent(event, "", "  ")
-			if err != nil {
-				msg = fmt.Sprintf("Error marshalling json: %q", err)
-			} else {
-				msg = "@djonas " + string(b[:])
-			}
-		} else {
-			// No error and not a query!
-			return nil
-		}
+		// No error and not a query!
+		return nil
 	default:
 		if name != "" {
 			msg = "@" + name + " You're a queryf."
 		} else {
 			msg = "You're a queryf."
 		}
+
+		if queryfImage != "" {
+			card = addon.NewImageCard("queryf", queryfImage, queryfImage)
+		}
 	}
 
-	notification := &addon.Notification{
-		MessageFormat: "text",
-		Notify:        true,
-		Message:       msg,
+	return reply(a, installation, match, event, addon.DeliverToRoom, msg, card)
+}
+
+func reply(a *addon.HipchatAddon, installation *addon.Installation, match *addon.MessageMatch, event map[string]interface{}, delivery addon.Delivery, msg string, card *addon.Card) error {
+	reply := &addon.Reply{
+		Delivery: delivery,
+		Notification: &addon.Notification{
+			MessageFormat: "text",
+			Notify:        true,
+			Message:       msg,
+			Card:          card,
+		},
 	}
 
-	if err := a.SendNotification(installation, notification); err != nil {
-		logrus.Error(err)
+	// Queued so a slow HipChat doesn't time out the webhook.
+	if err := a.EnqueueReply(installation, event, reply); err != nil {
+		ruleLogger(installation, match).Errorf("unable to queue reply: %v", err)
 		return err
 	}
 
@@ -81,57 +137,178 @@ func url(resource string) string {
 	return urlBase + resource
 }
 
+func splitList(s string) (list []string) {
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return
+}
+
 func main() {
+	flag.Usage = usage
 	flag.Parse()
 
-	host = os.Getenv("OPENSHIFT_GO_IP")
-	port, _ := strconv.Atoi(os.Getenv("OPENSHIFT_GO_PORT"))
-	stateFilename = os.Getenv("OPENSHIFT_DATA_DIR") + "state"
-	urlBase = "https://ohsnap-davidrjonas.rhcloud.com"
+	configure()
+
+	args := flag.Args()
+
+	// Plain "ohsnap" serves, as it always has.
+	if len(args) == 0 {
+		args = []string{"serve"}
+	}
+
+	if err := runCommand(args[0], args[1:]); err != nil {
+		if err == errUsage {
+			os.Exit(2)
+		}
+		logrus.Fatal(err)
+	}
+}
+
+// configure fills in what OpenShift tells us through the environment.
+func configure() {
+	if ip := os.Getenv("OPENSHIFT_GO_IP"); ip != "" {
+		host = ip
+		port, _ = strconv.Atoi(os.Getenv("OPENSHIFT_GO_PORT"))
+		stateFilename = os.Getenv("OPENSHIFT_DATA_DIR") + "state"
+
+		if urlBase == "" {
+			urlBase = "https://ohsnap-davidrjonas.rhcloud.com"
+		}
+	}
 
 	if urlBase == "" {
-		urlBase = fmt.Sprintf("http://%s:%d", host, port)
+		scheme := "http"
+		if tlsCert != "" {
+			scheme = "https"
+		}
+		urlBase = fmt.Sprintf("%s://%s", scheme, net.JoinHostPort(host, strconv.Itoa(port)))
 	}
+}
 
-	a := addon.NewWithStateFile(
-		&addon.CapabilitiesDescriptor{
-			Name:        "OhSnap",
-			Description: "Snappy replies when necessary.",
-			Key:         "ohsnap",
-			Vendor: &addon.Vendor{
-				Name: "davidrjonas",
-				Url:  "https://github.com/davidrjonas/ohsnap",
-			},
-			Links: &addon.Links{
-				Homepage: "https://github.com/davidrjonas/ohsnap",
-				Self:     url("/capabilities.json"),
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsOptions checks the -tls-* flags and loads the certificate once, so a
+// bad file is reported here rather than by New.
+func tlsOptions() ([]addon.HipchatAddonOption, error) {
+	if tlsCert == "" {
+		if tlsKey != "" || httpRedirect != "" {
+			return nil, errors.New("-tls-key and -http-redirect need -tls-cert")
+		}
+		return nil, nil
+	}
+
+	if _, err := tls.LoadX509KeyPair(tlsCert, tlsKey); err != nil {
+		return nil, fmt.Errorf("unable to load -tls-cert %s and -tls-key %s: %v", tlsCert, tlsKey, err)
+	}
+
+	version, ok := tlsVersions[tlsMinVersion]
+	if !ok {
+		return nil, fmt.Errorf("unknown -tls-min-version %q, want 1.0, 1.1, 1.2 or 1.3", tlsMinVersion)
+	}
+
+	return []addon.HipchatAddonOption{
+		addon.TLS(tlsCert, tlsKey),
+		addon.TLSMinVersion(version),
+		addon.HttpRedirect(httpRedirect),
+	}, nil
+}
+
+func newDescriptor() *addon.CapabilitiesDescriptor {
+	return &addon.CapabilitiesDescriptor{
+		Name:        "OhSnap",
+		Description: "Snappy replies when necessary.",
+		Key:         "ohsnap",
+		Vendor: &addon.Vendor{
+			Name: "davidrjonas",
+			Url:  "https://github.com/davidrjonas/ohsnap",
+		},
+		Links: &addon.Links{
+			Homepage: "https://github.com/davidrjonas/ohsnap",
+			Self:     url("/capabilities.json"),
+		},
+		Capabilities: &addon.Capabilities{
+			HipchatApiConsumer: &addon.HipchatApiConsumer{
+				Scopes: []string{"send_notification", "send_message"},
 			},
-			Capabilities: &addon.Capabilities{
-				HipchatApiConsumer: &addon.HipchatApiConsumer{
-					Scopes: []string{"send_notification"},
-				},
-				Installable: &addon.Installable{
-					AllowGlobal: false,
-					AllowRoom:   true,
-					CallbackUrl: url("/install"),
-				},
-				WebHook: []*addon.WebHook{&addon.WebHook{
-					Event:          "room_message",
-					Pattern:        "(?i)quer(y|ies)",
-					Authentication: "jwt",
-					Name:           "Yraquery",
-					Url:            url("/webhook/0"),
-
-					Callback: onYraQuery,
-				}},
+			Installable: &addon.Installable{
+				AllowGlobal: false,
+				AllowRoom:   true,
+				CallbackUrl: url("/install"),
 			},
+			WebHook: []*addon.WebHook{&addon.WebHook{
+				Event:          "room_message",
+				Pattern:        "(?i)quer(y|ies)",
+				Authentication: "jwt",
+				Name:           "Yraquery",
+				Url:            url("/webhook/0"),
+
+				Callback: addon.MessageRules(yraRules...),
+			}},
 		},
-		stateFilename,
-		addon.Logger(logrus.StandardLogger()),
-	)
+	}
+}
+
+// newAddon builds the addon from the flags. New panics on a bad option, such
+// as a -trusted-proxies entry that isn't an address or an outbox it can't
+// read; that is returned as an error here.
+func newAddon(store addon.InstallationStore, options ...addon.HipchatAddonOption) (a *addon.HipchatAddon, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
+	return addon.New(newDescriptor(), store, options...), nil
+}
+
+func serve(args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("serve takes no arguments, got %q", args)
+	}
+
+	options := []addon.HipchatAddonOption{
+		addon.Logger(addon.NewLogrusLogger(logrus.StandardLogger())),
+		addon.OutboxFile(stateFilename + ".outbox"),
+		addon.TrustedProxies(splitList(trustedProxies)...),
+	}
+
+	withTLS, err := tlsOptions()
+	if err != nil {
+		return err
+	}
+	options = append(options, withTLS...)
+
+	// A secret, so not a flag where anyone could read it from ps.
+	if token := os.Getenv("OHSNAP_ADMIN_TOKEN"); token != "" {
+		options = append(options, addon.AdminToken(token))
+	}
+
+	store, err := openStore()
+	if err != nil {
+		return err
+	}
+
+	a, err := newAddon(store, options...)
+	if err != nil {
+		return err
+	}
 
 	logrus.Infof("Saving state to file '%s'", stateFilename)
 	logrus.Infof("Starting server on %s:%d for url %s", host, port, urlBase)
 
-	a.Serve(fmt.Sprintf("%s:%d", host, port))
+	if err := a.Serve(fmt.Sprintf("%s:%d", host, port)); err != nil {
+		return err
+	}
+
+	logrus.Info("Stopped")
+
+	return nil
 }
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/davidrjonas/hipchat-addon"
+	"github.com/davidrjonas/hipchat-addon/addontest"
+)
+
+const replHelp = `Type a chat line to send it to the room. Commands:
+  /user NAME [ID]    Talk as another user
+  /room ID [NAME]    Move to another room
+  /raw               Toggle showing the event sent to the webhooks
+  /who               Show the user and room
+  /help              Show this
+  /quit              Leave, as does end of input
+`
+
+// chatRepl sends chat lines through the addon's webhooks as if typed in a
+// HipChat room and prints the replies.
+type chatRepl struct {
+	a          *addon.HipchatAddon
+	handler    http.Handler
+	descriptor *addon.CapabilitiesDescriptor
+	store      *addon.MemoryInstallationStore
+	doer       *addontest.Doer
+	out        io.Writer
+
+	user    addontest.User
+	room    addontest.Room
+	userIds map[string]int
+	rooms   map[int]*addon.Installation
+	raw     bool
+}
+
+func replCommand(args []string) error {
+	fs := flag.NewFlagSet("repl", flag.ExitOnError)
+	user := fs.String("user", "djonas", "The mention name to talk as")
+	roomId := fs.Int("room", 1, "The room to talk in")
+	raw := fs.Bool("raw", false, "Show the event sent to the webhooks")
+	verbose := fs.Bool("v", false, "Show the addon's info logs")
+	fs.Parse(args)
+
+	if !*verbose {
+		logrus.SetLevel(logrus.WarnLevel)
+	}
+
+	r := newChatRepl(os.Stdout)
+	r.raw = *raw
+	r.switchUser(*user, 0)
+	r.switchRoom(*roomId, "")
+
+	fmt.Fprint(r.out, replHelp)
+
+	return r.run(os.Stdin)
+}
+
+func newChatRepl(out io.Writer) *chatRepl {
+	store := addontest.NewStore()
+	doer := addontest.NewDoer()
+
+	descriptor := newDescriptor()
+
+	a := addon.New(descriptor, store,
+		addon.Logger(addon.NewLogrusLogger(logrus.StandardLogger())),
+		addon.HttpClient(doer),
+		addon.OutboundRetries(1, time.Millisecond),
+	)
+
+	return &chatRepl{
+		a:          a,
+		handler:    a.Handler(),
+		descriptor: descriptor,
+		store:      store,
+		doer:       doer,
+		out:        out,
+		userIds:    make(map[string]int),
+		rooms:      make(map[int]*addon.Installation),
+	}
+}
+
+func (r *chatRepl) run(in io.Reader) error {
+	scanner := bufio.NewScanner(in)
+
+	for {
+		fmt.Fprintf(r.out, "@%s in %s> ", r.user.MentionName, r.room.Name)
+
+		if !scanner.Scan() {
+			fmt.Fprintln(r.out)
+			return scanner.Err()
+		}
+
+		line := strings.TrimSpace(scanner.Text())
+
+		switch {
+		case line == "":
+			continue
+		case line == "/quit":
+			return nil
+		case strings.HasPrefix(line, "/"):
+			r.command(line)
+		default:
+			if err := r.say(line); err != nil {
+				fmt.Fprintf(r.out, "error: %v\n", err)
+			}
+		}
+	}
+}
+
+func (r *chatRepl) command(line string) {
+	fields := strings.Fields(line)
+
+	switch fields[0] {
+	case "/user":
+		if len(fields) < 2 || len(fields) > 3 {
+			fmt.Fprintln(r.out, "usage: /user NAME [ID]")
+			return
+		}
+		id := 0
+		if len(fields) == 3 {
+			var err error
+			if id, err = strconv.Atoi(fields[2]); err != nil {
+				fmt.Fprintln(r.out, "the user id must be a number")
+				return
+			}
+		}
+		r.switchUser(strings.TrimPrefix(fields[1], "@"), id)
+		r.who()
+
+	case "/room":
+		if len(fields) < 2 {
+			fmt.Fprintln(r.out, "usage: /room ID [NAME]")
+			return
+		}
+		id, err := strconv.Atoi(fields[1])
+		if err != nil {
+			fmt.Fprintln(r.out, "the room id must be a number")
+			return
+		}
+		r.switchRoom(id, strings.Join(fields[2:], " "))
+		r.who()
+
+	case "/raw":
+		r.raw = !r.raw
+		fmt.Fprintf(r.out, "raw events %s\n", map[bool]string{true: "on", false: "off"}[r.raw])
+
+	case "/who":
+		r.who()
+
+	case "/help":
+		fmt.Fprint(r.out, replHelp)
+
+	default:
+		fmt.Fprintf(r.out, "unknown command %s, try /help\n", fields[0])
+	}
+}
+
+func (r *chatRepl) who() {
+	fmt.Fprintf(r.out, "@%s (%d) in %s (%d)\n", r.user.MentionName, r.user.Id, r.room.Name, r.room.Id)
+}
+
+// switchUser talks as name. Without an id a user keeps the one they had or
+// gets the lowest free one. A user whose id is given to another forgets it.
+func (r *chatRepl) switchUser(name string, id int) {
+	if id == 0 {
+		id = r.userIds[name]
+	}
+	if id == 0 {
+		id = r.freeUserId()
+	}
+
+	for other, otherId := range r.userIds {
+		if otherId == id && other != name {
+			delete(r.userIds, other)
+		}
+	}
+	r.userIds[name] = id
+
+	r.user = addontest.User{Id: id, MentionName: name, Name: name}
+}
+
+func (r *chatRepl) freeUserId() int {
+	taken := make(map[int]bool, len(r.userIds))
+	for _, id := range r.userIds {
+		taken[id] = true
+	}
+
+	id := 1
+	for taken[id] {
+		id++
+	}
+
+	return id
+}
+
+func (r *chatRepl) userName(id string) string {
+	for name, userId := range r.userIds {
+		if strconv.Itoa(userId) == id {
+			return name
+		}
+	}
+	return id
+}
+
+// switchRoom moves to a room, installing the addon there the first time.
+func (r *chatRepl) switchRoom(id int, name string) {
+	if name == "" {
+		name = fmt.Sprintf("Room %d", id)
+	}
+
+	if r.rooms[id] == nil {
+		installation := addontest.NewInstallation(strconv.Itoa(id))
+		r.store.Add(installation.OauthId, installation)
+		r.rooms[id] = installation
+	}
+
+	r.room = addontest.Room{Id: id, Name: name}
+}
+
+// say posts the line to every room_message webhook whose pattern matches,
+// signed as HipChat would, and prints what they sent back.
+func (r *chatRepl) say(line string) error {
+	installation := r.rooms[r.room.Id]
+
+	events := addontest.NewEvents(installation)
+	events.Room = r.room
+	event := events.RoomMessage(r.user, line)
+
+	if r.raw {
+		b, _ := json.MarshalIndent(event, "", "  ")
+		fmt.Fprintf(r.out, "%s\n", b)
+	}
+
+	r.doer.Reset()
+
+	for _, webhook := range r.descriptor.Capabilities.WebHook {
+		if webhook.Event != "room_message" {
+			continue
+		}
+
+		// As HipChat would; the addon compiled the patterns.
+		switch _, result := r.a.MatchWebHook(webhook, line); result {
+		case addon.NoMatch:
+			continue
+		case addon.Unchecked:
+			fmt.Fprintf(r.out, "webhook %s not called: its pattern %q can't be checked locally\n", webhook.Name, webhook.Pattern)
+			continue
+		}
+
+		token := addontest.NewToken(installation).UserId(strconv.Itoa(r.user.Id))
+		req := addontest.NewWebhookRequest(webhook.Url, token, event)
+
+		w := &replResponse{header: http.Header{}}
+		r.handler.ServeHTTP(w, req)
+
+		if w.status != 0 && w.status != http.StatusOK {
+			fmt.Fprintf(r.out, "webhook %s answered %d\n", webhook.Name, w.status)
+		}
+	}
+
+	if err := r.waitForReplies(10 * time.Second); err != nil {
+		return err
+	}
+
+	for _, sent := range r.doer.Requests() {
+		r.printReply(sent)
+	}
+
+	return nil
+}
+
+// waitForReplies waits for the queued replies to be sent. Unlike DrainQueue
+// it leaves the queue open for the next line.
+func (r *chatRepl) waitForReplies(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+
+	for r.a.QueueStats().Depth > 0 {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("replies not sent after %v", timeout)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return nil
+}
+
+func (r *chatRepl) printReply(sent *addontest.RecordedRequest) {
+	if strings.HasSuffix(sent.Url.Path, "/oauth/token") {
+		return
+	}
+
+	var body struct {
+		Message string `json:"message"`
+		Card    *struct {
+			Title string `json:"title"`
+			Url   string `json:"url"`
+		} `json:"card"`
+	}
+
+	if err := sent.Decode(&body); err != nil {
+		fmt.Fprintf(r.out, "%s %s: %s\n", sent.Method, sent.Url.Path, sent.Body)
+		return
+	}
+
+	who := "ohsnap"
+	if parts := strings.Split(sent.Url.Path, "/"); len(parts) > 3 && parts[len(parts)-3] == "user" {
+		who = "ohsnap (privately to @" + r.userName(parts[len(parts)-2]) + ")"
+	}
+
+	fmt.Fprintf(r.out, "%s: %s\n", who, body.Message)
+
+	if body.Card != nil {
+		fmt.Fprintf(r.out, "  [card: %s %s]\n", body.Card.Title, body.Card.Url)
+	}
+}
+
+// replResponse is the least of an http.ResponseWriter; the replies that
+// matter are sent to HipChat, not in the response.
+type replResponse struct {
+	header http.Header
+	status int
+}
+
+func (w *replResponse) Header() http.Header {
+	return w.header
+}
+
+func (w *replResponse) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return len(b), nil
+}
+
+func (w *replResponse) WriteHeader(status int) {
+	w.status = status
+}
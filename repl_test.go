@@ -0,0 +1,37 @@
+package main
+
+import (
+	"io/ioutil"
+	"testing"
+)
+
+func TestReplUserIdsStayUnique(t *testing.T) {
+	r := newChatRepl(ioutil.Discard)
+
+	steps := []struct {
+		name string
+		id   int
+		want int
+	}{
+		{"alice", 0, 1},
+		{"bob", 2, 2},
+		{"carol", 0, 3}, // not 2, which bob has
+		{"alice", 0, 1},
+		{"dave", 1, 1}, // alice forgets 1
+		{"alice", 0, 4},
+	}
+
+	for _, step := range steps {
+		r.switchUser(step.name, step.id)
+
+		if r.user.Id != step.want {
+			t.Errorf("/user %s %d: got id %d, want %d", step.name, step.id, r.user.Id, step.want)
+		}
+	}
+
+	for id, name := range map[string]string{"1": "dave", "2": "bob", "3": "carol", "4": "alice"} {
+		if got := r.userName(id); got != name {
+			t.Errorf("user %s is %s, want %s", id, got, name)
+		}
+	}
+}
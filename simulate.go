@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/davidrjonas/hipchat-addon"
+	"github.com/jmoiron/jsonq"
+)
+
+const simulatedApiUrl = "https://hipchat.simulated.invalid/v2/"
+
+// SimulatedRequest is an API call a callback made, which was recorded
+// instead of sent.
+type SimulatedRequest struct {
+	Method string      `json:"method"`
+	Path   string      `json:"path"`
+	Body   interface{} `json:"body,omitempty"`
+}
+
+// recordingDoer answers HipChat API calls without a network. Tokens are
+// granted for whatever is asked; everything else is recorded and gets a 204.
+type recordingDoer struct {
+	requests []SimulatedRequest
+	mutex    sync.Mutex
+}
+
+func (d *recordingDoer) Do(req *http.Request) (*http.Response, error) {
+	if strings.HasSuffix(req.URL.Path, "/oauth/token") {
+		req.ParseForm()
+		token, _ := json.Marshal(map[string]interface{}{
+			"access_token": "simulated",
+			"token_type":   "bearer",
+			"scope":        req.PostForm.Get("scope"),
+			"expires_in":   3600,
+		})
+		return simulatedResponse(http.StatusOK, token), nil
+	}
+
+	recorded := SimulatedRequest{Method: req.Method, Path: req.URL.Path}
+
+	if req.Body != nil {
+		b, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		if len(b) > 0 {
+			if err := json.Unmarshal(b, &recorded.Body); err != nil {
+				recorded.Body = string(b)
+			}
+		}
+	}
+
+	stripCardIds(recorded.Body)
+
+	d.mutex.Lock()
+	d.requests = append(d.requests, recorded)
+	d.mutex.Unlock()
+
+	return simulatedResponse(http.StatusNoContent, nil), nil
+}
+
+func simulatedResponse(status int, body []byte) *http.Response {
+	return &http.Response{
+		StatusCode: status,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       ioutil.NopCloser(bytes.NewReader(body)),
+	}
+}
+
+// stripCardIds replaces the random card ids so outputs can be compared.
+func stripCardIds(body interface{}) {
+	m, ok := body.(map[string]interface{})
+	if !ok {
+		return
+	}
+	if card, ok := m["card"].(map[string]interface{}); ok {
+		if _, ok := card["id"]; ok {
+			card["id"] = "simulated-card-id"
+		}
+	}
+}
+
+// simulate runs the webhooks for the event in fixture and returns the API
+// calls they made. With webhookName only that webhook runs, otherwise every
+// webhook for the event. The webhook patterns are not applied.
+func simulate(fixture string, webhookName string) ([]SimulatedRequest, error) {
+	b, err := ioutil.ReadFile(fixture)
+	if err != nil {
+		return nil, err
+	}
+
+	event := map[string]interface{}{}
+
+	// Decoded the same way as by the webhook handler.
+	if err := json.Unmarshal(b, &event); err != nil {
+		return nil, fmt.Errorf("%s: %v", fixture, err)
+	}
+
+	jq := jsonq.NewQuery(event)
+
+	eventName, _ := jq.String("event")
+
+	roomId := "1"
+	if id, err := jq.Int("item", "room", "id"); err == nil {
+		roomId = fmt.Sprint(id)
+	}
+
+	installation := &addon.Installation{
+		OauthId:     "simulated",
+		OauthSecret: "simulated",
+		RoomId:      json.Number(roomId),
+		GroupId:     json.Number("1"),
+		TokenUrl:    simulatedApiUrl + "oauth/token",
+		ApiUrl:      simulatedApiUrl,
+	}
+
+	store := addon.NewMemoryInstallationStore()
+	store.Add(installation.OauthId, installation)
+	doer := &recordingDoer{}
+	descriptor := newDescriptor()
+
+	a := addon.New(descriptor, store,
+		addon.Logger(addon.NewLogrusLogger(logrus.StandardLogger())),
+		addon.HttpClient(doer),
+		// Fail fast; a retry would only hide a bug.
+		addon.OutboundRetries(1, time.Millisecond),
+	)
+
+	ran := 0
+
+	for _, webhook := range descriptor.Capabilities.WebHook {
+		if webhookName != "" && webhook.Name != webhookName {
+			continue
+		}
+		if webhookName == "" && webhook.Event != eventName {
+			continue
+		}
+
+		ran++
+
+		if err := webhook.Callback(a, installation, webhook, event); err != nil {
+			return nil, fmt.Errorf("webhook %s: %v", webhook.Name, err)
+		}
+	}
+
+	if ran == 0 {
+		return nil, fmt.Errorf("%s: no webhook for event %q", fixture, eventName)
+	}
+
+	// Replies may have been queued.
+	if err := a.DrainQueue(10 * time.Second); err != nil {
+		return nil, err
+	}
+
+	if failed := a.QueueStats().Failed; failed > 0 {
+		return nil, fmt.Errorf("%d queued messages could not be sent", failed)
+	}
+
+	// Recorded from several queue workers; different rooms may interleave.
+	sort.SliceStable(doer.requests, func(i, j int) bool {
+		return doer.requests[i].Path < doer.requests[j].Path
+	})
+
+	if doer.requests == nil {
+		doer.requests = []SimulatedRequest{}
+	}
+
+	return doer.requests, nil
+}
+
+func simulateCommand(args []string) error {
+	fs := flag.NewFlagSet("simulate", flag.ExitOnError)
+	eventFile := fs.String("event", "", "A webhook event fixture (json) to run")
+	dir := fs.String("dir", "", "Run every *.json fixture in this directory and compare with its .expected file")
+	webhookName := fs.String("webhook", "", "Only run the webhook with this name")
+	update := fs.Bool("update", false, "With -dir, write the .expected files instead of comparing")
+	fs.Parse(args)
+
+	switch {
+	case *eventFile != "" && *dir == "":
+		requests, err := simulate(*eventFile, *webhookName)
+		if err != nil {
+			return err
+		}
+		return printJson(os.Stdout, requests)
+
+	case *dir != "" && *eventFile == "":
+		return simulateDir(os.Stdout, *dir, *webhookName, *update)
+	}
+
+	return errors.New("simulate needs either -event FILE or -dir DIR")
+}
+
+// simulateDir runs the fixtures in dir. The expected output of foo.json is
+// in foo.expected.
+func simulateDir(w io.Writer, dir string, webhookName string, update bool) error {
+	fixtures, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+
+	if len(fixtures) == 0 {
+		return fmt.Errorf("no fixtures in %s", dir)
+	}
+
+	failures := 0
+
+	for _, fixture := range fixtures {
+		expectedFile := strings.TrimSuffix(fixture, ".json") + ".expected"
+
+		requests, err := simulate(fixture, webhookName)
+		if err != nil {
+			fmt.Fprintf(w, "FAIL %s: %v\n", fixture, err)
+			failures++
+			continue
+		}
+
+		actual, _ := json.MarshalIndent(requests, "", "  ")
+		actual = append(actual, '\n')
+
+		if update {
+			if err := ioutil.WriteFile(expectedFile, actual, 0644); err != nil {
+				return err
+			}
+			fmt.Fprintf(w, "wrote %s\n", expectedFile)
+			continue
+		}
+
+		expected, err := ioutil.ReadFile(expectedFile)
+		if err != nil {
+			fmt.Fprintf(w, "FAIL %s: %v (run with -update to create it)\n", fixture, err)
+			failures++
+			continue
+		}
+
+		if !sameJson(expected, actual) {
+			fmt.Fprintf(w, "FAIL %s\n--- expected\n%s--- actual\n%s", fixture, expected, actual)
+			failures++
+			continue
+		}
+
+		fmt.Fprintf(w, "ok   %s\n", fixture)
+	}
+
+	if failures > 0 {
+		return fmt.Errorf("%d of %d fixtures failed", failures, len(fixtures))
+	}
+
+	return nil
+}
+
+func sameJson(a []byte, b []byte) bool {
+	var va, vb interface{}
+
+	if json.Unmarshal(a, &va) != nil || json.Unmarshal(b, &vb) != nil {
+		return false
+	}
+
+	return reflect.DeepEqual(va, vb)
+}
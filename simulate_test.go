@@ -0,0 +1,16 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// The same as `ohsnap simulate -dir testdata/events`; update the .expected
+// files with its -update.
+func TestEventFixtures(t *testing.T) {
+	var out bytes.Buffer
+
+	if err := simulateDir(&out, "testdata/events", "", false); err != nil {
+		t.Errorf("%v\n%s", err, out.String())
+	}
+}